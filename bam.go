@@ -1,29 +1,31 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"os/exec"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
 )
 
 type BamScanner struct {
 	LineNumber int
 	filename   string
 	stdin      bool
-	scanner    *bufio.Scanner
+	source     *bam.Reader
+	closer     io.Closer
 	wg         sync.WaitGroup
 	prev       string
-	record     []string
+	record     *BamRecord
 	Closed     bool
 }
 
 type BamRecord struct {
+	Rec         *sam.Record
 	Qname       string
 	Flag        int
 	Rname       string
@@ -40,77 +42,97 @@ type BamRecord struct {
 	MatchLength int
 }
 
-var cigarPattern *regexp.Regexp = regexp.MustCompile(`[0-9][0-9]*[A-Z]`)
-
-func (r *BamRecord) Load(record []string) error {
-	r.Qname = record[0]
-	r.Rname = record[2]
-	r.Cigar = record[5]
-	r.Rnext = record[6]
-	r.Seq = record[9]
-	r.Qual = record[10]
-	var err error
-	if r.Flag, err = strconv.Atoi(record[1]); err != nil {
-		return err
+// Load populates r from a decoded sam.Record, pulling out the AS, HI and nM
+// tags and summing the M-operations of the CIGAR into MatchLength.
+func (r *BamRecord) Load(rec *sam.Record) error {
+	r.Rec = rec
+	r.Qname = rec.Name
+	r.Flag = int(rec.Flags)
+	if rec.Ref != nil {
+		r.Rname = rec.Ref.Name()
 	}
-	if r.Pos, err = strconv.Atoi(record[3]); err != nil {
-		return err
+	r.Pos = rec.Pos
+	r.Mapq = int(rec.MapQ)
+	r.Cigar = rec.Cigar.String()
+	if rec.MateRef != nil {
+		r.Rnext = rec.MateRef.Name()
 	}
-	if r.Mapq, err = strconv.Atoi(record[4]); err != nil {
-		return err
+	r.Pnext = rec.MatePos
+	r.Seq = string(rec.Seq.Expand())
+	r.Qual = string(rec.Qual)
+
+	if aux, ok := rec.Tag([]byte("AS")); ok {
+		r.TagAS = auxToInt(aux)
 	}
-	if r.Pnext, err = strconv.Atoi(record[7]); err != nil {
-		return err
+	if aux, ok := rec.Tag([]byte("HI")); ok {
+		r.TagHI = auxToInt(aux)
 	}
-	for i := 11; i < len(record); i++ {
-		val, err := strconv.Atoi(record[i][5:])
-		if err != nil {
-			return fmt.Errorf("failed to parse tag: %s", record[i])
-		}
-		switch record[i][0:5] {
-		case "AS:i:":
-			r.TagAS = val
-		case "HI:i:":
-			r.TagHI = val
-		case "nM:i:":
-			r.TagnM = val
-		}
+	if aux, ok := rec.Tag([]byte("nM")); ok {
+		r.TagnM = auxToInt(aux)
 	}
 
-	matches := cigarPattern.FindAllStringSubmatch(r.Cigar, -1)
-	for _, match := range matches {
-		code := match[0]
-		if len(code) > 0 && code[len(code)-1] == 'M' {
-			n, err := strconv.Atoi(code[0:(len(code) - 1)])
-			if err != nil {
-				return fmt.Errorf("failed to parse cigar fragment: %s", code)
-			}
-			r.MatchLength += n
+	for _, op := range rec.Cigar {
+		if op.Type() == sam.CigarMatch {
+			r.MatchLength += op.Len()
 		}
 	}
 
 	return nil
 }
 
+// auxToInt reads out the numeric value of a SAM tag regardless of which
+// integer width it was encoded with.
+func auxToInt(aux sam.Aux) int {
+	switch v := aux.Value().(type) {
+	case int8:
+		return int(v)
+	case uint8:
+		return int(v)
+	case int16:
+		return int(v)
+	case uint16:
+		return int(v)
+	case int32:
+		return int(v)
+	case uint32:
+		return int(v)
+	}
+	return 0
+}
+
+// OpenBam opens a BAM file and returns a BamScanner that decodes it natively
+// with biogo/hts rather than shelling out to samtools.
+//
+// CRAM is not supported: biogo/hts's cram package only exposes
+// container/block-level access, not a per-record sam.Record reader, so there
+// is no way to satisfy the same decode interface for it.
 func OpenBam(bamfile string) (*BamScanner, error) {
+	if strings.HasSuffix(bamfile, ".cram") {
+		return nil, fmt.Errorf("%s: CRAM input is not supported", bamfile)
+	}
+
 	s := BamScanner{}
 	s.filename = bamfile
-	cmd := exec.Command("samtools", "view", bamfile)
-	input, err := cmd.StdoutPipe()
+
+	fp, err := os.Open(bamfile)
 	if err != nil {
-		return nil, fmt.Errorf("failed creating pipe: %v", err)
+		return nil, fmt.Errorf("failed to open %s: %v", bamfile, err)
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("command failed to start: %v", err)
+	s.closer = fp
+
+	reader, err := bam.NewReader(fp, 0)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("failed to open bam %s: %v", bamfile, err)
 	}
-	s.scanner = bufio.NewScanner(input)
+	s.source = reader
+
 	s.wg.Add(1)
 	go func() {
 		s.wg.Wait()
-
 		if !s.stdin {
-			if err := cmd.Wait(); err != nil {
-				log.Fatal("wait failed: ", err)
+			if err := s.closer.Close(); err != nil {
+				logger.Printf("failed to close %s: %v", s.filename, err)
 			}
 		}
 	}()
@@ -118,7 +140,7 @@ func OpenBam(bamfile string) (*BamScanner, error) {
 }
 
 // Fast forward to the next record with read name `read`
-func (s *BamScanner) Find(read string) ([]string, error) {
+func (s *BamScanner) Find(read string) (*BamRecord, error) {
 	for {
 		// The end of the file may have been reached previously.
 		if s.Closed {
@@ -132,11 +154,11 @@ func (s *BamScanner) Find(read string) ([]string, error) {
 		if s.Closed {
 			return nil, nil
 		}
-		if record[0] == read {
+		if record.Qname == read {
 			s.Ratchet()
 			return record, nil
 		}
-		if strnum_cmp(record[0], read) < 0 {
+		if strnum_cmp(record.Qname, read) < 0 {
 			// Not far enough yet
 			s.Ratchet()
 		} else {
@@ -148,33 +170,30 @@ func (s *BamScanner) Find(read string) ([]string, error) {
 	}
 }
 
-func (s *BamScanner) Record() ([]string, error) {
+func (s *BamScanner) Record() (*BamRecord, error) {
 	if s.record != nil {
 		return s.record, nil
 	}
-	s.Closed = !s.scanner.Scan()
-	if err := s.scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanner of %s errored: %v", s.filename, err)
-	}
-	if s.Closed {
+	rec, err := s.source.Read()
+	if err == io.EOF {
+		s.Closed = true
 		return nil, nil
 	}
-	line := strings.TrimSpace(s.scanner.Text())
-	s.LineNumber++
-	if len(line) == 0 {
-		return nil, fmt.Errorf("empty BAM record")
+	if err != nil {
+		return nil, fmt.Errorf("scanner of %s errored: %v", s.filename, err)
 	}
-	s.record = strings.Split(line, "\t")
-	if len(s.record) == 0 {
-		return nil, fmt.Errorf("empty record at line %s", s.LineNumber)
+	s.LineNumber++
+	var record BamRecord
+	if err := record.Load(rec); err != nil {
+		return nil, fmt.Errorf("failed to load record at line %d: %v", s.LineNumber, err)
 	}
-	read := s.record[0]
 	if s.prev != "" {
-		if strnum_cmp(s.prev, read) > 0 {
+		if strnum_cmp(s.prev, record.Qname) > 0 {
 			return nil, fmt.Errorf("sorting order violated at line %d", s.LineNumber)
 		}
 	}
-	s.prev = read
+	s.prev = record.Qname
+	s.record = &record
 	return s.record, nil
 }
 
@@ -182,24 +201,209 @@ func (s *BamScanner) Ratchet() {
 	s.record = nil
 }
 
+// Filename returns the path this scanner was opened with.
+func (s *BamScanner) Filename() string {
+	return s.filename
+}
+
 func (s *BamScanner) Done() {
 	s.wg.Done()
 }
 
-func ReadBamHeader(bamfile string) (string, error) {
-	output, err := exec.Command("samtools", "view", "-H", bamfile).Output()
+func ReadBamHeader(bamfile string) (*sam.Header, error) {
+	if strings.HasSuffix(bamfile, ".cram") {
+		return nil, fmt.Errorf("%s: CRAM input is not supported", bamfile)
+	}
+
+	fp, err := os.Open(bamfile)
 	if err != nil {
-		return "", fmt.Errorf("failed to read header: %v", err)
+		return nil, fmt.Errorf("failed to open %s: %v", bamfile, err)
 	}
-	return string(output), nil
+	defer fp.Close()
+
+	reader, err := bam.NewReader(fp, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	return reader.Header(), nil
 }
 
 type BamWriter struct {
 	filename string
-	wg       sync.WaitGroup
-	fp       *os.File
+	header   *sam.Header
+	rgID     string
+	enc      interface {
+		Write(r *sam.Record) error
+	}
+	fp      *os.File
+	records chan *sam.Record
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
 }
 
-func (w *BamWriter) Wait() {
+// NewBamWriter opens filename for writing in the given format ("sam" or
+// "bam"), writes header immediately, and starts a goroutine that drains
+// queued records onto the encoder. rgID, if non-empty, is stamped onto every
+// queued record's RG tag that doesn't already carry one; a merged writer
+// instead lets the caller set a per-record RG before queueing, since each
+// record there may come from a different source BAM.
+//
+// CRAM is not supported: biogo/hts has no CRAM encoder.
+func NewBamWriter(filename, format string, header *sam.Header, rgID string) (*BamWriter, error) {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", filename, err)
+	}
+
+	var enc interface {
+		Write(r *sam.Record) error
+	}
+	switch format {
+	case "bam":
+		enc, err = bam.NewWriter(fp, header, 0)
+	case "sam":
+		enc, err = sam.NewWriter(fp, header, sam.FlagDecimal)
+	case "cram":
+		fp.Close()
+		return nil, fmt.Errorf("CRAM output is not supported")
+	default:
+		fp.Close()
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("failed to write header to %s: %v", filename, err)
+	}
+
+	w := &BamWriter{
+		filename: filename,
+		header:   header,
+		rgID:     rgID,
+		enc:      enc,
+		fp:       fp,
+		records:  make(chan *sam.Record, 1024),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+func (w *BamWriter) run() {
+	defer w.wg.Done()
+	for rec := range w.records {
+		if w.rgID != "" {
+			if _, ok := rec.Tag([]byte("RG")); !ok {
+				if err := setAux(rec, "RG", w.rgID); err != nil {
+					w.errOnce.Do(func() {
+						w.err = fmt.Errorf("failed to tag record for %s: %v", w.filename, err)
+					})
+					continue
+				}
+			}
+		}
+		if err := w.enc.Write(rec); err != nil {
+			w.errOnce.Do(func() {
+				w.err = fmt.Errorf("failed to write record to %s: %v", w.filename, err)
+			})
+		}
+	}
+}
+
+// Queue submits a record to be written asynchronously.
+func (w *BamWriter) Queue(rec *sam.Record) {
+	w.records <- rec
+}
+
+// Wait drains the queue, closes the encoder (if it needs closing) and the
+// underlying file, and returns the first write error encountered, if any.
+func (w *BamWriter) Wait() error {
+	close(w.records)
 	w.wg.Wait()
+	if closer, ok := w.enc.(io.Closer); ok {
+		if err := closer.Close(); err != nil && w.err == nil {
+			w.err = fmt.Errorf("failed to close %s: %v", w.filename, err)
+		}
+	}
+	if err := w.fp.Close(); err != nil && w.err == nil {
+		w.err = fmt.Errorf("failed to close %s: %v", w.filename, err)
+	}
+	return w.err
+}
+
+// setAux sets rec's tag to value, replacing any existing tag of the same
+// name. sam.Record has no setter of its own, only Tag for reading.
+func setAux(rec *sam.Record, tag string, value interface{}) error {
+	t := sam.NewTag(tag)
+	aux, err := sam.NewAux(t, value)
+	if err != nil {
+		return fmt.Errorf("failed to build %s tag: %v", tag, err)
+	}
+	for i, existing := range rec.AuxFields {
+		if existing.Tag() == t {
+			rec.AuxFields[i] = aux
+			return nil
+		}
+	}
+	rec.AuxFields = append(rec.AuxFields, aux)
+	return nil
+}
+
+// addReadGroup adds an @RG line named label to header, which must not be
+// shared with anything else (the caller owns it, e.g. via Header.Clone).
+func addReadGroup(header *sam.Header, label string) error {
+	rg, err := sam.NewReadGroup(label, "", "", "", "", "", "", "", "", "", time.Time{}, 0)
+	if err != nil {
+		return fmt.Errorf("failed to build read group %s: %v", label, err)
+	}
+	if err := header.AddReadGroup(rg); err != nil {
+		return fmt.Errorf("failed to add read group %s: %v", label, err)
+	}
+	return nil
+}
+
+// BuildLabelHeader clones header and adds a single @RG line named label, for
+// per-label (-output-dir) output, where every record in the file shares the
+// same label.
+func BuildLabelHeader(header *sam.Header, label string) (*sam.Header, error) {
+	cloned := header.Clone()
+	if err := addReadGroup(cloned, label); err != nil {
+		return nil, err
+	}
+	return cloned, nil
+}
+
+// BuildMergedHeader merges the @SQ lines of headers (via sam.MergeHeaders),
+// adds one @RG per label and a @PG line recording this invocation of
+// bestbamhit. It also returns, for each input header, the mapping from that
+// header's reference IDs to the corresponding *sam.Reference in the merged
+// header, so that records read against an input header can be re-targeted
+// at the merged one before being written.
+func BuildMergedHeader(headers []*sam.Header, labels []string, argv []string) (*sam.Header, [][]*sam.Reference, error) {
+	var merged *sam.Header
+	var reflinks [][]*sam.Reference
+
+	if len(headers) == 1 {
+		merged = headers[0].Clone()
+		reflinks = [][]*sam.Reference{merged.Refs()}
+	} else {
+		var err error
+		merged, reflinks, err = sam.MergeHeaders(headers)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to merge headers: %v", err)
+		}
+	}
+
+	for _, label := range labels {
+		if err := addReadGroup(merged, label); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pg := sam.NewProgram("bestbamhit", "bestbamhit", strings.Join(argv, " "), "", version)
+	if err := merged.AddProgram(pg); err != nil {
+		return nil, nil, fmt.Errorf("failed to add @PG line: %v", err)
+	}
+
+	return merged, reflinks, nil
 }
@@ -9,18 +9,29 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/biogo/hts/sam"
 )
 
+const version = "0.1.0"
+
 type Args struct {
 	MinScore     int
 	MaxDist      int
 	Limit        int
 	Penalty      float64
+	Bonus        float64
+	Seed         int64
 	Labels       string
 	LogFilename  string
 	KeepFilename string
+	OutputFormat string
+	OutputDir    string
+	MergedOutput string
+	StatsJSON    string
 }
 
 type Hit struct {
@@ -37,9 +48,15 @@ func init() {
 	flag.IntVar(&args.MaxDist, "max-dist", 5, "max edit distance for an alignment")
 	flag.IntVar(&args.Limit, "limit", 0, "limit the number of sample reads considered (0 = no limit)")
 	flag.Float64Var(&args.Penalty, "edit-penalty", 2.0, "multiple for how to penalize edit distance")
+	flag.Float64Var(&args.Bonus, "match-bonus", 1.0, "multiple for how to reward match length as a fraction of read length")
+	flag.Int64Var(&args.Seed, "seed", 1, "seed for random tie-breaking fallback, so runs are reproducible")
 	flag.StringVar(&args.Labels, "labels", "", "comma-separated list of labels for the BAMs (required)")
 	flag.StringVar(&args.LogFilename, "log", "", "write parameters and stats to a log file")
 	flag.StringVar(&args.KeepFilename, "keep", "", "file where to write the names of reads matching the first bam file")
+	flag.StringVar(&args.OutputFormat, "output-format", "bam", "format for best-hit alignment output: sam or bam (CRAM is not supported by the underlying library)")
+	flag.StringVar(&args.OutputDir, "output-dir", "", "directory to write one best-hit alignment file per label (disabled if empty)")
+	flag.StringVar(&args.MergedOutput, "merged-output", "", "path to write a single merged best-hit alignment file, tagged with an RG per source BAM; overrides -output-dir")
+	flag.StringVar(&args.StatsJSON, "stats-json", "", "path to write structured stats as JSON, in addition to the human-readable log")
 
 	flag.Usage = func() {
 		log.Println("usage: bestbamhit [options] a.bam b.bam ...")
@@ -73,6 +90,67 @@ func LogArguments() {
 	logger.Println(string(blob))
 }
 
+// openOutputWriters sets up best-hit alignment output according to
+// -merged-output / -output-dir. Exactly one of perLabel/merged is non-nil:
+// perLabel has one writer per input BAM, merged is a single writer shared by
+// all of them. mergedRefs[i] maps a reference ID from bams[i]'s own header
+// to the corresponding *sam.Reference in merged's header, since records read
+// against their own header must be re-targeted at the merged one before
+// being written to it.
+func openOutputWriters(bams, labels []string) (perLabel []*BamWriter, merged *BamWriter, mergedRefs [][]*sam.Reference, err error) {
+	if args.MergedOutput == "" && args.OutputDir == "" {
+		return nil, nil, nil, nil
+	}
+
+	headers := make([]*sam.Header, len(bams))
+	for i, b := range bams {
+		headers[i], err = ReadBamHeader(b)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read header of %s: %v", b, err)
+		}
+	}
+
+	if args.MergedOutput != "" {
+		mergedHeader, reflinks, err := BuildMergedHeader(headers, labels, os.Args)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		merged, err = NewBamWriter(args.MergedOutput, args.OutputFormat, mergedHeader, "")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, merged, reflinks, nil
+	}
+
+	perLabel = make([]*BamWriter, len(labels))
+	for i, label := range labels {
+		labelHeader, err := BuildLabelHeader(headers[i], label)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		filename := filepath.Join(args.OutputDir, fmt.Sprintf("%s.%s", label, args.OutputFormat))
+		perLabel[i], err = NewBamWriter(filename, args.OutputFormat, labelHeader, label)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return perLabel, nil, nil, nil
+}
+
+// closeOutputWriters waits for every writer to drain and reports the first
+// write error encountered, if any.
+func closeOutputWriters(perLabel []*BamWriter, merged *BamWriter) error {
+	if merged != nil {
+		return merged.Wait()
+	}
+	for _, w := range perLabel {
+		if err := w.Wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
 	bams := flag.Args()
@@ -91,6 +169,10 @@ func main() {
 	}
 
 	labels := strings.Split(args.Labels, ",")
+	if len(labels) != len(bams) {
+		logger.Printf("must specify one label per BAM file: got %d labels for %d BAMs\n", len(labels), len(bams))
+		os.Exit(1)
+	}
 
 	LogArguments()
 
@@ -115,6 +197,8 @@ func main() {
 		}
 	}
 
+	rng := rand.New(rand.NewSource(args.Seed))
+
 	scanners := make([]*BamScanner, len(bams))
 
 	for c := 0; c < len(bams); c++ {
@@ -124,6 +208,16 @@ func main() {
 		}
 	}
 
+	perLabelWriters, mergedWriter, mergedRefs, err := openOutputWriters(bams, labels)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	merger, err := NewMerger(scanners)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
 	total_mappings := 0
 	too_diverged := 0
 	tooLow := 0
@@ -134,6 +228,12 @@ func main() {
 	accepted := 0
 	counts := make([]int, len(bams))
 
+	editDistHist := make([]int, args.MaxDist+2) // 0..MaxDist plus an overflow bucket
+	scoreHist := make(map[string]int)
+	medianEstimator := NewP2Estimator(0.5)
+	p90Estimator := NewP2Estimator(0.9)
+	p99Estimator := NewP2Estimator(0.99)
+
 	err = func() error {
 		defer benchmark(startedAt, "processing")
 
@@ -146,64 +246,20 @@ func main() {
 				return nil
 			}
 
-			var read string
-
-			// Find the indexes of the scanners that present the lowest-ordered read.
-			all_closed := true
-			for _, s := range scanners {
-				record, err := s.Record()
-				if err != nil {
-					return err
-				}
-				if s.Closed {
-					continue
-				}
-				all_closed = false
-				if read == "" {
-					read = record[0]
-				} else {
-					if strnum_cmp(record[0], read) < 0 {
-						read = record[0]
-					}
-				}
-			}
-			if all_closed {
-				return nil
+			read, hits, err := merger.Next()
+			if err != nil {
+				return err
 			}
 			if read == "" {
-				return fmt.Errorf("Failed to find read")
-			}
-
-			// Get all the records from all the bams that are for this read.
-			var hits []Hit
-			for i, s := range scanners {
-				for {
-					record, err := s.Record()
-					if err != nil {
-						return err
-					}
-					if record == nil || record[0] != read {
-						break
-					}
-					hit := Hit{Index: i}
-					err = hit.Record.Load(record)
-					if err != nil {
-						return err
-					}
-					hits = append(hits, hit)
-					s.Ratchet()
-				}
-			}
-			if len(hits) == 0 {
-				return fmt.Errorf("No hits for %s", read)
+				return nil
 			}
 			total_mappings += len(hits)
 
-			// Determine which of the hits has the best alignment
-			var best_score int
+			// Determine which of the hits has the best composite score.
+			var best_score float64
 			var which_best []int
 			for j, hit := range hits {
-				score := hit.Record.TagAS
+				score := CompositeScore(&hit.Record, args.Penalty, args.Bonus)
 				if len(which_best) == 0 {
 					best_score = score
 					which_best = append(which_best, j)
@@ -217,9 +273,8 @@ func main() {
 				}
 			}
 			var best int
-			// If there are multiple best hits then we randomly select one.
 			if len(which_best) > 1 {
-				best = which_best[rand.Intn(len(which_best))]
+				best = bestOf(hits, which_best, rng)
 				first_source := hits[which_best[0]].Index
 
 				// Check if they're not all identical, in which case increment multi
@@ -242,15 +297,38 @@ func main() {
 					return err
 				}
 				if bestHit.Record.TagnM > args.MaxDist {
+					editDistHist[len(editDistHist)-1]++
 					too_diverged++
 				} else if bestHit.Record.TagAS < args.MinScore {
+					editDistHist[bestHit.Record.TagnM]++
 					tooLow++
 				} else {
+					editDistHist[bestHit.Record.TagnM]++
+					scoreHist[scoreBucket(bestHit.Record.TagAS)]++
+					medianEstimator.Add(float64(mlen))
+					p90Estimator.Add(float64(mlen))
+					p99Estimator.Add(float64(mlen))
 					totalMatchLen += mlen
 					accepted += 1
 					counts[bestHit.Index] += 1
 					if keep_writer != nil {
-						fmt.Fprintf(keep_writer, "%s\t%s\n", hits[best].Record.Qname, labels[bestHit.Index])
+						fmt.Fprintf(keep_writer, "%s\t%s\t%f\n", hits[best].Record.Qname, labels[bestHit.Index], best_score)
+					}
+					if mergedWriter != nil {
+						rec := bestHit.Record.Rec
+						if err := setAux(rec, "RG", labels[bestHit.Index]); err != nil {
+							return err
+						}
+						refs := mergedRefs[bestHit.Index]
+						if rec.Ref != nil {
+							rec.Ref = refs[rec.Ref.ID()]
+						}
+						if rec.MateRef != nil {
+							rec.MateRef = refs[rec.MateRef.ID()]
+						}
+						mergedWriter.Queue(rec)
+					} else if perLabelWriters != nil {
+						perLabelWriters[bestHit.Index].Queue(bestHit.Record.Rec)
 					}
 				}
 			}
@@ -261,6 +339,10 @@ func main() {
 		logger.Fatal(err)
 	}
 
+	if err := closeOutputWriters(perLabelWriters, mergedWriter); err != nil {
+		logger.Fatal(err)
+	}
+
 	avgMatchLen := float64(totalMatchLen) / float64(accepted)
 
 	logger.Printf("total\t%d\n", total_mappings)
@@ -283,4 +365,36 @@ func main() {
 	}
 	logger.Println(statsStr)
 
+	if args.StatsJSON != "" {
+		labelCounts := make([]LabelCount, len(labels))
+		for c, count := range counts {
+			labelCounts[c] = LabelCount{Label: labels[c], Accepted: count}
+		}
+		scannersConsumed := make([]ScannerCount, len(scanners))
+		for c, s := range scanners {
+			scannersConsumed[c] = ScannerCount{Filename: s.Filename(), RecordsConsumed: s.LineNumber}
+		}
+		statsDoc := Stats{
+			TotalMappings: total_mappings,
+			TooLow:        tooLow,
+			TooDiverged:   too_diverged,
+			Reads:         found,
+			ERCC:          ercc,
+			Multi:         multi,
+			Accepted:      accepted,
+			Labels:        labelCounts,
+			MatchLength: MatchLengthStats{
+				Average: avgMatchLen,
+				Median:  medianEstimator.Value(),
+				P90:     p90Estimator.Value(),
+				P99:     p99Estimator.Value(),
+			},
+			EditDistanceHistogram: editDistHist,
+			ScoreHistogram:        scoreHist,
+			ScannersConsumed:      scannersConsumed,
+		}
+		if err := WriteStatsJSON(args.StatsJSON, statsDoc); err != nil {
+			logger.Fatal(err)
+		}
+	}
 }
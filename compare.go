@@ -1,75 +1,84 @@
 package main
 
-import (
-	"log"
-	"strconv"
-	"unicode"
-)
-
-func digitToInt(s string) int {
-	n, err := strconv.Atoi(s)
-	if err != nil {
-		log.Fatal("failed to parse digit ", err)
-	}
-	return n
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
+// strnum_cmp compares two strings the way samtools orders read names: runs
+// of digits compare numerically (after skipping leading zeros) rather than
+// lexicographically, everything else compares byte by byte. It operates
+// directly on byte indices into as/bs, so unlike a []rune-based comparison
+// it never allocates, and it compares digit runs by length rather than by
+// parsing them, so there's no ceiling on how many digits a run can hold.
+//
+// Two digit runs that are numerically equal but padded with a different
+// number of leading zeros (e.g. "01" vs "1") are not a tie: samtools treats
+// the run that consumed more leading zeros as the smaller one, so "a01"
+// sorts before "a1". zerosA/zerosB below track that per-side zero count so
+// the comparison can still be made without parsing the digits as a number.
+//
 // From: https://github.com/samtools/samtools/blob/develop/bam_sort.c#L13
 func strnum_cmp(as, bs string) int {
-	a := []rune(as)
-	b := []rune(bs)
-	i := 0
-	j := 0
-	for i < len(a) && j < len(b) {
-		if unicode.IsDigit(a[i]) && unicode.IsDigit(b[j]) {
-			for i < len(a) && a[i] == '0' {
+	i, j := 0, 0
+	for i < len(as) && j < len(bs) {
+		if isDigit(as[i]) && isDigit(bs[j]) {
+			zeros_i, zeros_j := 0, 0
+			for i < len(as) && as[i] == '0' {
 				i++
+				zeros_i++
 			}
-			for j < len(b) && b[j] == '0' {
+			for j < len(bs) && bs[j] == '0' {
 				j++
+				zeros_j++
 			}
-			for i < len(a) && j < len(b) && unicode.IsDigit(a[i]) && unicode.IsDigit(b[j]) && a[i] == b[j] {
+
+			start_i, start_j := i, j
+			for i < len(as) && isDigit(as[i]) {
 				i++
+			}
+			for j < len(bs) && isDigit(bs[j]) {
 				j++
 			}
-			// By this point we've forwarded across any leading zeros && any digits that match.
-			// Next we get determine if they have the same number of digits
-			// before the first non-diget. If so we use the numerical values of
-			// the number formed by these digits to determine order.
-			if i < len(a) && j < len(b) && unicode.IsDigit(a[i]) && unicode.IsDigit(b[j]) {
-				k := 0
-				for i+k < len(a) && unicode.IsDigit(a[i+k]) && j+k < len(b) && unicode.IsDigit(b[j+k]) {
-					k += 1
+
+			// Two digit runs of equal length compare the same lexicographically
+			// as they would numerically, since leading zeros have already been
+			// skipped. A shorter run after skipping zeros is always the smaller
+			// number. Only once the runs are numerically equal does the number
+			// of leading zeros stripped from each side break the tie.
+			switch {
+			case i-start_i != j-start_j:
+				if i-start_i < j-start_j {
+					return -1
 				}
-				if i+k < len(a) && unicode.IsDigit(a[i+k]) {
-					return 1
-				} else if j+k < len(b) && unicode.IsDigit(b[j+k]) {
+				return 1
+			case as[start_i:i] != bs[start_j:j]:
+				if as[start_i:i] < bs[start_j:j] {
 					return -1
-				} else {
-					return digitToInt(string(a[i:(i+k)])) - digitToInt(string(b[j:(j+k)]))
 				}
-			} else if i < len(a) && unicode.IsDigit(a[i]) {
 				return 1
-			} else if j < len(b) && unicode.IsDigit(b[j]) {
-				return -1
-			} else if i != j {
-				if i < j {
-					return 1
+			case zeros_i != zeros_j:
+				if zeros_i > zeros_j {
+					return -1
 				}
-				return -1
+				return 1
 			}
 		} else {
-			if a[i] != b[j] {
-				return digitToInt(string(a[i])) - digitToInt(string(b[j]))
+			if as[i] != bs[j] {
+				if as[i] < bs[j] {
+					return -1
+				}
+				return 1
 			}
 			i++
 			j++
 		}
 	}
-	if len(a) > len(b) {
+	switch {
+	case len(as) > len(bs):
 		return 1
-	} else if len(a) < len(b) {
+	case len(as) < len(bs):
 		return -1
+	default:
+		return 0
 	}
-	return 0
 }
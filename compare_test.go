@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+// referenceStrnumCmp is a direct transliteration of samtools' strnum_cmp from
+// bam_sort.c, used only to cross-check strnum_cmp in tests. It parses digit
+// runs with math/big so it has no overflow ceiling of its own, unlike the
+// original log.Fatal-on-overflow implementation this package replaced.
+func referenceStrnumCmp(as, bs string) int {
+	a, b := []byte(as), []byte(bs)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			for i < len(a) && a[i] == '0' {
+				i++
+			}
+			for j < len(b) && b[j] == '0' {
+				j++
+			}
+			for i < len(a) && j < len(b) && isDigit(a[i]) && isDigit(b[j]) && a[i] == b[j] {
+				i++
+				j++
+			}
+			if i < len(a) && j < len(b) && isDigit(a[i]) && isDigit(b[j]) {
+				k := 0
+				for i+k < len(a) && isDigit(a[i+k]) && j+k < len(b) && isDigit(b[j+k]) {
+					k++
+				}
+				if i+k < len(a) && isDigit(a[i+k]) {
+					return 1
+				} else if j+k < len(b) && isDigit(b[j+k]) {
+					return -1
+				}
+				na := new(big.Int)
+				na.SetString(string(a[i:i+k]), 10)
+				nb := new(big.Int)
+				nb.SetString(string(b[j:j+k]), 10)
+				return na.Cmp(nb)
+			} else if i < len(a) && isDigit(a[i]) {
+				return 1
+			} else if j < len(b) && isDigit(b[j]) {
+				return -1
+			} else if i != j {
+				if i < j {
+					return 1
+				}
+				return -1
+			}
+		} else {
+			if a[i] != b[j] {
+				if a[i] < b[j] {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
+		}
+	}
+	switch {
+	case len(a) > len(b):
+		return 1
+	case len(a) < len(b):
+		return -1
+	default:
+		return 0
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func TestStrnumCmpAgainstReference(t *testing.T) {
+	cases := []struct{ a, b string }{
+		{"a01", "a1"},
+		{"a1", "a01"},
+		{"read007", "read7"},
+		{"read7", "read007"},
+		{"read10", "read9"},
+		{"read2", "read10"},
+		{"a00", "a0"},
+		{"a0", "a00"},
+		{"abc", "abd"},
+		{"a1b2", "a1b2"},
+		{"a001b002", "a1b2"},
+		{"", ""},
+		{"a", ""},
+		{"", "a"},
+		{"0", "00"},
+		{"00", "0"},
+	}
+	for _, c := range cases {
+		got := sign(strnum_cmp(c.a, c.b))
+		want := sign(referenceStrnumCmp(c.a, c.b))
+		if got != want {
+			t.Errorf("strnum_cmp(%q, %q) = %d, reference = %d", c.a, c.b, got, want)
+		}
+	}
+}
+
+func FuzzStrnumCmp(f *testing.F) {
+	for _, seed := range []struct{ a, b string }{
+		{"a01", "a1"},
+		{"read007", "read7"},
+		{"read10", "read9"},
+		{"a0", "a"},
+	} {
+		f.Add(seed.a, seed.b)
+	}
+	f.Fuzz(func(t *testing.T, a, b string) {
+		got := sign(strnum_cmp(a, b))
+		want := sign(referenceStrnumCmp(a, b))
+		if got != want {
+			t.Errorf("strnum_cmp(%q, %q) = %d, reference = %d", a, b, got, want)
+		}
+	})
+}
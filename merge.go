@@ -0,0 +1,132 @@
+package main
+
+import "container/heap"
+
+// streamBufferSize bounds how far each scanner's goroutine is allowed to
+// read ahead of the merger.
+const streamBufferSize = 64
+
+// readBatch groups every consecutive record for one read name from a single
+// BamScanner, along with any error encountered producing it.
+type readBatch struct {
+	qname   string
+	records []*BamRecord
+	err     error
+}
+
+// stream starts a goroutine that reads s ahead into a bounded channel of
+// readBatch, grouping consecutive records with the same read name. This lets
+// every input BAM be decoded concurrently instead of one record at a time in
+// lockstep with the others. The existing sort-order validation in s.Record
+// still applies to each scanner independently.
+func (s *BamScanner) stream(bufSize int) <-chan readBatch {
+	ch := make(chan readBatch, bufSize)
+	go func() {
+		defer close(ch)
+		for {
+			record, err := s.Record()
+			if err != nil {
+				ch <- readBatch{err: err}
+				return
+			}
+			if record == nil {
+				return
+			}
+			qname := record.Qname
+			var records []*BamRecord
+			for {
+				record, err := s.Record()
+				if err != nil {
+					ch <- readBatch{err: err}
+					return
+				}
+				if record == nil || record.Qname != qname {
+					break
+				}
+				records = append(records, record)
+				s.Ratchet()
+			}
+			ch <- readBatch{qname: qname, records: records}
+		}
+	}()
+	return ch
+}
+
+// heapEntry is one scanner's current head batch, as tracked by the merger's
+// min-heap.
+type heapEntry struct {
+	index int
+	batch readBatch
+}
+
+type mergeHeap []heapEntry
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	return strnum_cmp(h[i].batch.qname, h[j].batch.qname) < 0
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(heapEntry)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+	return entry
+}
+
+// Merger performs a parallel k-way merge of several BamScanners, each
+// running ahead in its own goroutine, and emits the hits for one read at a
+// time in sorted order via Next.
+type Merger struct {
+	chans []<-chan readBatch
+	heap  mergeHeap
+}
+
+// NewMerger starts one streaming goroutine per scanner and primes the heap
+// with each scanner's first batch.
+func NewMerger(scanners []*BamScanner) (*Merger, error) {
+	m := &Merger{chans: make([]<-chan readBatch, len(scanners))}
+	for i, s := range scanners {
+		m.chans[i] = s.stream(streamBufferSize)
+	}
+	heap.Init(&m.heap)
+	for i := range scanners {
+		batch, ok := <-m.chans[i]
+		if !ok {
+			continue
+		}
+		if batch.err != nil {
+			return nil, batch.err
+		}
+		heap.Push(&m.heap, heapEntry{index: i, batch: batch})
+	}
+	return m, nil
+}
+
+// Next returns the hits for the next read in sort order across every
+// scanner, along with that read's name. It returns ("", nil, nil) once every
+// scanner is exhausted.
+func (m *Merger) Next() (string, []Hit, error) {
+	if m.heap.Len() == 0 {
+		return "", nil, nil
+	}
+	read := m.heap[0].batch.qname
+
+	var hits []Hit
+	for m.heap.Len() > 0 && m.heap[0].batch.qname == read {
+		entry := heap.Pop(&m.heap).(heapEntry)
+		for _, rec := range entry.batch.records {
+			hits = append(hits, Hit{Index: entry.index, Record: *rec})
+		}
+
+		next, ok := <-m.chans[entry.index]
+		if ok {
+			if next.err != nil {
+				return "", nil, next.err
+			}
+			heap.Push(&m.heap, heapEntry{index: entry.index, batch: next})
+		}
+	}
+	return read, hits, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import "math/rand"
+
+// CompositeScore combines alignment score, edit distance and match length
+// into a single figure of merit used to pick the best hit for a read:
+//
+//	score = TagAS - Penalty*TagnM + Bonus*MatchLength/readLen
+func CompositeScore(r *BamRecord, penalty, bonus float64) float64 {
+	readLen := len(r.Seq)
+	if readLen == 0 {
+		return float64(r.TagAS) - penalty*float64(r.TagnM)
+	}
+	return float64(r.TagAS) - penalty*float64(r.TagnM) + bonus*float64(r.MatchLength)/float64(readLen)
+}
+
+// bestOf picks the best-scoring hit among which_best (all tied on
+// CompositeScore). Ties are broken deterministically by preferring, in
+// order: lower TagnM, longer MatchLength, lower TagHI, then lexicographic
+// Rname+Pos. Only if every one of those is also tied does it fall back to
+// rng, so that two genuinely indistinguishable hits still resolve
+// reproducibly given the same seed.
+func bestOf(hits []Hit, which_best []int, rng *rand.Rand) int {
+	best := which_best[0]
+	for _, j := range which_best[1:] {
+		if tieBreak(hits[j].Record, hits[best].Record) < 0 {
+			best = j
+		}
+	}
+
+	// Collect every candidate that's still fully tied with best, and break
+	// that remaining tie at random.
+	var fullyTied []int
+	for _, j := range which_best {
+		if tieBreak(hits[j].Record, hits[best].Record) == 0 {
+			fullyTied = append(fullyTied, j)
+		}
+	}
+	if len(fullyTied) > 1 {
+		return fullyTied[rng.Intn(len(fullyTied))]
+	}
+	return best
+}
+
+// tieBreak orders two hits already tied on CompositeScore. It returns a
+// negative number if a should be preferred over b, positive if b should be
+// preferred, and 0 if they're indistinguishable by every criterion.
+func tieBreak(a, b BamRecord) int {
+	if a.TagnM != b.TagnM {
+		return a.TagnM - b.TagnM
+	}
+	if a.MatchLength != b.MatchLength {
+		return b.MatchLength - a.MatchLength
+	}
+	if a.TagHI != b.TagHI {
+		return a.TagHI - b.TagHI
+	}
+	aKey := a.Rname + posKey(a.Pos)
+	bKey := b.Rname + posKey(b.Pos)
+	if aKey != bKey {
+		if aKey < bKey {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// posKey renders a position as a fixed-width string so that lexicographic
+// comparison of Rname+Pos agrees with numeric comparison of Pos.
+func posKey(pos int) string {
+	const width = 20
+	s := ""
+	for n := pos; n > 0; n /= 10 {
+		s = string(rune('0'+n%10)) + s
+	}
+	for len(s) < width {
+		s = "0" + s
+	}
+	return s
+}
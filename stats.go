@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// P2Estimator estimates a single quantile of a stream in O(1) memory using
+// the P² algorithm, so percentiles can be reported without holding every
+// match length seen.
+//
+// From: Jain & Chlamtac, "The P2 Algorithm for Dynamic Calculation of
+// Quantiles and Histograms Without Storing Observations" (1985).
+type P2Estimator struct {
+	p       float64
+	initial []float64
+	count   int
+	n       [5]float64
+	np      [5]float64
+	dn      [5]float64
+	q       [5]float64
+}
+
+// NewP2Estimator returns an estimator for the p-th quantile, 0 < p < 1.
+func NewP2Estimator(p float64) *P2Estimator {
+	return &P2Estimator{p: p}
+}
+
+// Add folds one more observation into the estimate.
+func (e *P2Estimator) Add(x float64) {
+	if e.count < 5 {
+		e.initial = append(e.initial, x)
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.initial)
+			for i := 0; i < 5; i++ {
+				e.q[i] = e.initial[i]
+				e.n[i] = float64(i + 1)
+			}
+			e.np = [5]float64{1, 1 + 2*e.p, 1 + 4*e.p, 3 + 2*e.p, 5}
+			e.dn = [5]float64{0, e.p / 2, e.p, (1 + e.p) / 2, 1}
+		}
+		return
+	}
+	e.count++
+
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+		k = 0
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for i := 0; i < 4; i++ {
+			if e.q[i] <= x && x < e.q[i+1] {
+				k = i
+				break
+			}
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.n[i]++
+	}
+	for i := 0; i < 5; i++ {
+		e.np[i] += e.dn[i]
+	}
+
+	for i := 1; i < 4; i++ {
+		d := e.np[i] - e.n[i]
+		if (d >= 1 && e.n[i+1]-e.n[i] > 1) || (d <= -1 && e.n[i-1]-e.n[i] < -1) {
+			sign := 1.0
+			if d < 0 {
+				sign = -1.0
+			}
+			qNew := e.parabolic(i, sign)
+			if e.q[i-1] < qNew && qNew < e.q[i+1] {
+				e.q[i] = qNew
+			} else {
+				e.q[i] = e.linear(i, sign)
+			}
+			e.n[i] += sign
+		}
+	}
+}
+
+func (e *P2Estimator) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/(e.n[i+1]-e.n[i-1])*((e.n[i]-e.n[i-1]+d)*(e.q[i+1]-e.q[i])/(e.n[i+1]-e.n[i])+
+		(e.n[i+1]-e.n[i]-d)*(e.q[i]-e.q[i-1])/(e.n[i]-e.n[i-1]))
+}
+
+func (e *P2Estimator) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.q[i] + d*(e.q[j]-e.q[i])/(e.n[j]-e.n[i])
+}
+
+// Value returns the current quantile estimate, or 0 if nothing has been
+// added yet.
+func (e *P2Estimator) Value() float64 {
+	if e.count == 0 {
+		return 0
+	}
+	if e.count < 5 {
+		sorted := append([]float64(nil), e.initial...)
+		sort.Float64s(sorted)
+		idx := int(e.p * float64(len(sorted)-1))
+		return sorted[idx]
+	}
+	return e.q[2]
+}
+
+// scoreBucketWidth groups alignment scores into fixed-width bins for the
+// alignment-score histogram, since AS can range widely but we don't need
+// per-value resolution.
+const scoreBucketWidth = 10
+
+func scoreBucket(score int) string {
+	lo := (score / scoreBucketWidth) * scoreBucketWidth
+	return fmt.Sprintf("%d-%d", lo, lo+scoreBucketWidth-1)
+}
+
+// Stats is the structured document written to -stats-json.
+type Stats struct {
+	TotalMappings         int              `json:"total_mappings"`
+	TooLow                int              `json:"too_low"`
+	TooDiverged           int              `json:"too_diverged"`
+	Reads                 int              `json:"reads"`
+	ERCC                  int              `json:"ercc"`
+	Multi                 int              `json:"multi"`
+	Accepted              int              `json:"accepted"`
+	Labels                []LabelCount     `json:"labels"`
+	MatchLength           MatchLengthStats `json:"match_length"`
+	EditDistanceHistogram []int            `json:"edit_distance_histogram"`
+	ScoreHistogram        map[string]int   `json:"alignment_score_histogram"`
+	ScannersConsumed      []ScannerCount   `json:"scanners_consumed"`
+}
+
+type LabelCount struct {
+	Label    string `json:"label"`
+	Accepted int    `json:"accepted"`
+}
+
+type MatchLengthStats struct {
+	Average float64 `json:"average"`
+	Median  float64 `json:"median"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+}
+
+type ScannerCount struct {
+	Filename        string `json:"filename"`
+	RecordsConsumed int    `json:"records_consumed"`
+}
+
+// WriteStatsJSON marshals stats and writes it to filename.
+func WriteStatsJSON(filename string, stats Stats) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", filename, err)
+	}
+	defer fp.Close()
+
+	enc := json.NewEncoder(fp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stats); err != nil {
+		return fmt.Errorf("failed to write stats to %s: %v", filename, err)
+	}
+	return nil
+}